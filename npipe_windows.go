@@ -41,13 +41,22 @@ package npipe
 //sys waitNamedPipe(name *uint16, timeout uint32) (err error) = WaitNamedPipeW
 //sys createEvent(sa *syscall.SecurityAttributes, manualReset bool, initialState bool, name *uint16) (handle syscall.Handle, err error) [failretval==syscall.InvalidHandle] = CreateEventW
 //sys getOverlappedResult(handle syscall.Handle, overlapped *syscall.Overlapped, transferred *uint32, wait bool) (err error) = GetOverlappedResult
+//sys convertStringSecurityDescriptorToSecurityDescriptor(str *uint16, revision uint32, sd *uintptr, size *uint32) (err error) = advapi32.ConvertStringSecurityDescriptorToSecurityDescriptorW
+//sys getNamedPipeClientProcessId(handle syscall.Handle, clientProcessId *uint32) (err error) = kernel32.GetNamedPipeClientProcessId
+//sys setNamedPipeHandleState(handle syscall.Handle, mode *uint32, maxCollectionCount *uint32, collectDataTimeout *uint32) (err error) = SetNamedPipeHandleState
+//sys impersonateNamedPipeClient(handle syscall.Handle) (err error) = advapi32.ImpersonateNamedPipeClient
+//sys revertToSelf() (err error) = advapi32.RevertToSelf
+//sys openThreadToken(thread syscall.Handle, access uint32, openAsSelf bool, token *syscall.Token) (err error) = advapi32.OpenThreadToken
+//sys getCurrentThread() (handle syscall.Handle) = kernel32.GetCurrentThread
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"strconv"
+	"runtime"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
@@ -103,6 +112,10 @@ const (
 
 const SECURITY_DESCRIPTOR_REVISION = 1
 
+// SDDL_REVISION_1 is the only revision defined by
+// ConvertStringSecurityDescriptorToSecurityDescriptor.
+const SDDL_REVISION_1 = 1
+
 var (
 	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
 	procInitializeSecurityDescriptor = advapi32.NewProc("InitializeSecurityDescriptor")
@@ -140,6 +153,30 @@ func initSecurityAttributes() (*syscall.SecurityAttributes, error) {
 
 }
 
+// securityAttributesFromSDDL converts an SDDL string, such as
+// "D:P(A;;GA;;;BA)(A;;GA;;;SY)", into a SECURITY_ATTRIBUTES that restricts
+// access to a named pipe to the principals named in the string. This lets
+// callers lock a pipe down to specific SIDs instead of using the wide-open
+// NULL DACL that initSecurityAttributes produces.
+func securityAttributesFromSDDL(sddl string) (*syscall.SecurityAttributes, error) {
+	str, err := syscall.UTF16PtrFromString(sddl)
+	if err != nil {
+		return nil, err
+	}
+
+	var sd uintptr
+	var size uint32
+	if err := convertStringSecurityDescriptorToSecurityDescriptor(str, SDDL_REVISION_1, &sd, &size); err != nil {
+		return nil, os.NewSyscallError("ConvertStringSecurityDescriptorToSecurityDescriptorW", err)
+	}
+
+	var sa syscall.SecurityAttributes
+	sa.Length = uint32(unsafe.Sizeof(sa))
+	sa.SecurityDescriptor = sd
+
+	return &sa, nil
+}
+
 // PipeError is an error related to a call to a pipe
 type PipeError struct {
 	msg     string
@@ -177,50 +214,62 @@ func (e PipeError) Temporary() bool {
 //	// remote pipe
 //	conn, err := Dial(`\\othercomp\pipe\mypipename`)
 func Dial(address string) (*PipeConn, error) {
-	for {
-		conn, err := dial(address, nmpwait_wait_forever)
-		if err == nil {
-			return conn, nil
-		}
-		if isPipeNotReady(err) {
-			<-time.After(100 * time.Millisecond)
-			continue
-		}
-		return nil, err
-	}
+	return DialContext(context.Background(), address)
 }
 
 // DialTimeout acts like Dial, but will time out after the duration of timeout
 func DialTimeout(address string, timeout time.Duration) (*PipeConn, error) {
-	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := DialContext(ctx, address)
+	if err == context.DeadlineExceeded {
+		return nil, PipeError{fmt.Sprintf(
+			"Timed out waiting for pipe '%s' to come available", address), true}
+	}
+	return conn, err
+}
+
+// dialPollInterval bounds how long a single DialContext attempt blocks
+// inside WaitNamedPipeW before rechecking ctx, so cancellation is noticed
+// promptly even though WaitNamedPipeW itself cannot be interrupted mid-call.
+const dialPollInterval = 100 * time.Millisecond
+
+// DialContext acts like Dial, but the pending connection attempt is
+// abandoned as soon as ctx is done, returning ctx.Err(). Dial and
+// DialTimeout are implemented on top of DialContext so there is a single
+// retry loop.
+func DialContext(ctx context.Context, address string) (*PipeConn, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		millis := uint32(dialPollInterval / time.Millisecond)
+		if deadline, ok := ctx.Deadline(); ok {
+			if remaining := time.Until(deadline); remaining < dialPollInterval {
+				// ctx's timer can fire a little after its deadline, so
+				// remaining may already be negative here; clamp it so it
+				// never becomes 0 (the pipe's default wait) or wraps to
+				// a huge uint32 (0xFFFFFFFF means wait forever).
+				if remaining < time.Millisecond {
+					remaining = time.Millisecond
+				}
+				millis = uint32(remaining / time.Millisecond)
+			}
+		}
 
-	now := time.Now()
-	for now.Before(deadline) {
-		millis := uint32(deadline.Sub(now) / time.Millisecond)
 		conn, err := dial(address, millis)
 		if err == nil {
 			return conn, nil
 		}
-		if err == error_sem_timeout {
-			// This is WaitNamedPipe's timeout error, so we know we're done
-			return nil, PipeError{fmt.Sprintf(
-				"Timed out waiting for pipe '%s' to come available", address), true}
-		}
-		if isPipeNotReady(err) {
-			left := deadline.Sub(time.Now())
-			retry := 100 * time.Millisecond
-			if left > retry {
-				<-time.After(retry)
-			} else {
-				<-time.After(left - time.Millisecond)
-			}
-			now = time.Now()
+		// error_sem_timeout is WaitNamedPipe's own timeout for this
+		// poll interval, not necessarily ctx's deadline; loop back
+		// around to let the ctx.Err() check above decide.
+		if err == error_sem_timeout || isPipeNotReady(err) {
 			continue
 		}
 		return nil, err
 	}
-	return nil, PipeError{fmt.Sprintf(
-		"Timed out waiting for pipe '%s' to come available", address), true}
 }
 
 // isPipeNotReady checks the error to see if it indicates the pipe is not ready
@@ -304,7 +353,88 @@ func dial(address string, timeout uint32) (*PipeConn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &PipeConn{handle: handle, addr: PipeAddr(address)}, nil
+	return newPipeConn(handle, PipeAddr(address), false), nil
+}
+
+// DialMessage is like Dial, but switches the client end of the pipe into
+// message read mode so that ReadMessage/WriteMessage (or PacketConn) can be
+// used to preserve the message boundaries the server wrote with
+// ListenMessage.
+func DialMessage(address string) (*PipeConn, error) {
+	conn, err := Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.setMessageMode(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// setMessageMode switches the connection's read mode to message mode and
+// marks it so ReadMessage/WriteMessage can be used on it.
+func (c *PipeConn) setMessageMode() error {
+	mode := uint32(pipe_readmode_message)
+	if err := setNamedPipeHandleState(c.handle, &mode, nil, nil); err != nil {
+		return os.NewSyscallError("SetNamedPipeHandleState", err)
+	}
+	c.messageMode = true
+	return nil
+}
+
+// ListenConfig configures the named pipe instances created by
+// ListenConfigured. The zero value is not used directly; ListenConfigured
+// fills in the same defaults Listen has always used for any field left
+// unset.
+type ListenConfig struct {
+	// OutBufferSize and InBufferSize hint the pipe's output and input
+	// buffer sizes to the OS. Zero selects the default of 512 bytes,
+	// matching the previous hardcoded behavior.
+	OutBufferSize uint32
+	InBufferSize  uint32
+
+	// MaxInstances limits how many concurrent instances of the pipe may
+	// exist. Zero selects pipe_unlimited_instances, matching the
+	// previous hardcoded behavior.
+	MaxInstances uint32
+
+	// MessageMode opens the pipe with PIPE_TYPE_MESSAGE and
+	// PIPE_READMODE_MESSAGE instead of the default byte mode, so message
+	// boundaries set by the writer are preserved for the reader. Use
+	// ReadMessage/WriteMessage on the resulting PipeConn.
+	MessageMode bool
+
+	// FirstInstanceOnly causes Listen to fail if a pipe with this name
+	// already exists, by passing FILE_FLAG_FIRST_PIPE_INSTANCE to
+	// CreateNamedPipe.
+	FirstInstanceOnly bool
+
+	// SecurityDescriptor is an SDDL string, such as
+	// "D:P(A;;GA;;;BA)(A;;GA;;;SY)", describing which principals may
+	// connect to the pipe. If empty, a NULL DACL is used, allowing any
+	// local user to connect; this matches the previous behavior of
+	// Listen.
+	SecurityDescriptor string
+}
+
+// resolveListenConfig fills in default values for any zero fields in cfg,
+// or returns an all-defaults config if cfg is nil.
+func resolveListenConfig(cfg *ListenConfig) ListenConfig {
+	var resolved ListenConfig
+	if cfg != nil {
+		resolved = *cfg
+	}
+	if resolved.OutBufferSize == 0 {
+		resolved.OutBufferSize = 512
+	}
+	if resolved.InBufferSize == 0 {
+		resolved.InBufferSize = 512
+	}
+	if resolved.MaxInstances == 0 {
+		resolved.MaxInstances = pipe_unlimited_instances
+	}
+	return resolved
 }
 
 // New returns a new PipeListener that will listen on a pipe with the given address.
@@ -312,16 +442,32 @@ func dial(address string, timeout uint32) (*PipeConn, error) {
 //
 // Listen will return a PipeError for an incorrectly formatted pipe name.
 func Listen(address string) (*PipeListener, error) {
-	//handle, err := createPipe(address, true)
+	return ListenConfigured(address, nil)
+}
+
+// ListenMessage is like Listen, but opens the pipe in message mode so that
+// message boundaries written by clients are preserved for readers. Use
+// ReadMessage/WriteMessage (or PacketConn) on the resulting connections
+// instead of Read/Write.
+func ListenMessage(address string) (*PipeListener, error) {
+	return ListenConfigured(address, &ListenConfig{MessageMode: true})
+}
+
+// ListenConfigured is like Listen, but lets the caller control the pipe's
+// buffer sizes, instance limit, and security descriptor via cfg. A nil cfg
+// is equivalent to Listen.
+func ListenConfigured(address string, cfg *ListenConfig) (*PipeListener, error) {
+	resolved := resolveListenConfig(cfg)
+	//handle, err := createPipeConfigured(address, true, &resolved)
 	/*because we used single one ,so do this*/
-	handle, err := createPipe(address, false)
+	handle, err := createPipeConfigured(address, resolved.FirstInstanceOnly, &resolved)
 	if err == error_invalid_name {
 		return nil, badAddr(address)
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &PipeListener{PipeAddr(address), handle, false}, nil
+	return &PipeListener{addr: PipeAddr(address), handle: handle, config: &resolved}, nil
 }
 
 // PipeListener is a named pipe listener. Clients should typically
@@ -330,6 +476,159 @@ type PipeListener struct {
 	addr   PipeAddr
 	handle syscall.Handle
 	closed bool
+	config *ListenConfig
+
+	// The following are only set by ListenPool, where several pipe
+	// instances are kept listening concurrently and fed into acceptCh
+	// as they connect, instead of Accept creating a new instance itself
+	// each time it's called.
+	acceptCh    chan *PipeConn
+	poolDone    chan struct{}
+	poolWG      sync.WaitGroup
+	poolMu      sync.Mutex
+	poolHandles []syscall.Handle
+	poolStopped bool // guarded by poolMu; set atomically with the Close snapshot below
+}
+
+// ListenPool is like ListenConfigured, but pre-creates workers named pipe
+// instances up front and runs ConnectNamedPipe on all of them
+// concurrently, so a slow handler on one connection does not delay new
+// clients from connecting while Accept is busy elsewhere; ready
+// connections queue up in a buffered channel that
+// Accept/AcceptPipe/AcceptContext drain. This is the multi-instance
+// server pattern documented for named pipes, and it matters a lot for
+// RPC-style servers under concurrent load. A nil cfg is equivalent to
+// Listen; MessageMode and SecurityDescriptor apply to every instance in
+// the pool just as they would for a single Listen call. FirstInstanceOnly
+// applies only to the pool's first worker, matching Listen's semantics of
+// failing if the pipe name is already in use elsewhere; it does not limit
+// the pool to one instance.
+func ListenPool(address string, workers int, cfg *ListenConfig) (*PipeListener, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	resolved := resolveListenConfig(cfg)
+	if resolved.MaxInstances < uint32(workers) {
+		resolved.MaxInstances = uint32(workers)
+	}
+
+	l := &PipeListener{
+		addr:        PipeAddr(address),
+		config:      &resolved,
+		acceptCh:    make(chan *PipeConn, workers),
+		poolDone:    make(chan struct{}),
+		poolHandles: make([]syscall.Handle, workers),
+	}
+
+	for i := 0; i < workers; i++ {
+		// FirstInstanceOnly only makes sense for the pipe's very first
+		// instance; the remaining workers' instances always coexist
+		// with it, just like the single-instance Listen/AcceptPipe
+		// path only passes first for the initial handle.
+		first := i == 0 && resolved.FirstInstanceOnly
+		handle, err := createPipeConfigured(address, first, &resolved)
+		if err == error_invalid_name {
+			l.Close()
+			return nil, badAddr(address)
+		}
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.poolHandles[i] = handle
+		l.poolWG.Add(1)
+		go l.runPoolWorker(i, handle)
+	}
+	return l, nil
+}
+
+// commitPoolHandle decides, under poolMu, whether runPoolWorker still owns
+// poolHandles[i] after a successful connect. Checking poolStopped and
+// clearing poolHandles must happen in the very critical section Close uses
+// for its snapshot, the same way the replacement-handle registration in
+// runPoolWorker does: a check done outside the lock (or after it) could
+// observe "not stopped yet" and then have Close's whole snapshot-and-close
+// sequence run in the gap before the caller acts, closing the handle out
+// from under the connection it is about to hand off. Once poolStopped is
+// observed true here, Close has already included this handle in its
+// snapshot and owns closing it, so the caller must not touch it again.
+func (l *PipeListener) commitPoolHandle(i int) bool {
+	l.poolMu.Lock()
+	defer l.poolMu.Unlock()
+	if l.poolStopped {
+		return false
+	}
+	l.poolHandles[i] = 0
+	return true
+}
+
+// runPoolWorker services one pipe instance of a ListenPool listener: it
+// waits for a client to connect, hands the resulting PipeConn to acceptCh,
+// then creates a fresh instance and repeats, keeping the pool at a
+// constant number of concurrently listening instances.
+func (l *PipeListener) runPoolWorker(i int, handle syscall.Handle) {
+	defer l.poolWG.Done()
+	for {
+		overlapped, err := newOverlapped()
+		if err != nil {
+			return
+		}
+		err = connectNamedPipe(handle, overlapped)
+		if err != nil && err != error_pipe_connected {
+			if err == error_io_incomplete || err == syscall.ERROR_IO_PENDING {
+				_, err = waitForCompletion(handle, 0, overlapped)
+			}
+		}
+		syscall.CloseHandle(overlapped.HEvent)
+
+		if err != nil && err != error_pipe_connected {
+			// A real connect failure, or Close cancelled us via
+			// CancelIoEx (typically surfaced as ERROR_OPERATION_ABORTED).
+			// In the latter case Close's own snapshot already owns
+			// closing this handle, so there is nothing left to do
+			// either way.
+			return
+		}
+
+		// handle is about to be handed off to a PipeConn a caller may
+		// already be reading/writing; commitPoolHandle decides, under
+		// the same lock Close uses for its snapshot, whether we still
+		// own it.
+		if !l.commitPoolHandle(i) {
+			return
+		}
+
+		conn := newPipeConn(handle, l.addr, l.config != nil && l.config.MessageMode)
+		select {
+		case l.acceptCh <- conn:
+		case <-l.poolDone:
+			conn.Close()
+			return
+		}
+
+		handle, err = createPipeConfigured(string(l.addr), false, l.config)
+		if err != nil {
+			return
+		}
+
+		// Registering the replacement and checking poolStopped must
+		// happen in the same critical section that Close uses to set
+		// poolStopped and take its handle snapshot: otherwise a
+		// registration landing in the gap between Close reading
+		// poolHandles and Close closing poolDone would be invisible
+		// to both Close's snapshot and any later check, leaking the
+		// handle and leaving this worker (and poolWG.Wait) stuck
+		// forever waiting on a connect no one will ever cancel.
+		l.poolMu.Lock()
+		if l.poolStopped {
+			l.poolMu.Unlock()
+			syscall.CancelIoEx(handle, nil)
+			syscall.CloseHandle(handle)
+			return
+		}
+		l.poolHandles[i] = handle
+		l.poolMu.Unlock()
+	}
 }
 
 // Accept implements the Accept method in the net.Listener interface; it
@@ -342,11 +641,28 @@ func (l *PipeListener) Accept() (net.Conn, error) {
 	return c, nil
 }
 
-func (l *PipeListener) _acceptPipe(mills int) (*PipeConn, error) {
+// AcceptContext is like AcceptPipe, but the pending connect is abandoned as
+// soon as ctx is done, returning ctx.Err(). While the connect is pending, a
+// watcher goroutine calls CancelIoEx on the overlapped handle when ctx is
+// cancelled so the accept unblocks promptly instead of waiting out
+// whatever timeout the caller would otherwise have used.
+func (l *PipeListener) AcceptContext(ctx context.Context) (*PipeConn, error) {
 	if l == nil || l.addr == "" || l.closed {
 		return nil, syscall.EINVAL
 	}
 
+	if l.acceptCh != nil {
+		select {
+		case conn, ok := <-l.acceptCh:
+			if !ok {
+				return nil, syscall.EINVAL
+			}
+			return conn, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
 	// the first time we call accept, the handle will have been created by the Listen
 	// call. This is to prevent race conditions where the client thinks the server
 	// isn't listening because it hasn't actually called create yet. After the first time, we'll
@@ -354,7 +670,7 @@ func (l *PipeListener) _acceptPipe(mills int) (*PipeConn, error) {
 	handle := l.handle
 	if handle == 0 {
 		var err error
-		handle, err = createPipe(string(l.addr), false)
+		handle, err = createPipeConfigured(string(l.addr), false, l.config)
 		if err != nil {
 			return nil, err
 		}
@@ -373,23 +689,47 @@ func (l *PipeListener) _acceptPipe(mills int) (*PipeConn, error) {
 	}()
 	if err := connectNamedPipe(handle, overlapped); err != nil && err != error_pipe_connected {
 		if err == error_io_incomplete || err == syscall.ERROR_IO_PENDING {
-			_, err = waitForCompletion(handle, mills, overlapped)
+			watchDone := make(chan struct{})
+			defer close(watchDone)
+			go func() {
+				select {
+				case <-ctx.Done():
+					syscall.CancelIoEx(handle, overlapped)
+				case <-watchDone:
+				}
+			}()
+			_, err = waitForCompletion(handle, 0, overlapped)
+			if err != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return nil, ctxErr
+				}
+			}
 		}
 		if err != nil {
 			return nil, err
 		}
 	}
-	return &PipeConn{handle: handle, addr: l.addr}, nil
+	return newPipeConn(handle, l.addr, l.config != nil && l.config.MessageMode), nil
 }
 
-// AcceptPipe accepts the next incoming call and returns the new connection.
+// AcceptTimeout accepts the next incoming call and returns the new
+// connection, giving up after mills milliseconds.
 func (l *PipeListener) AcceptTimeout(mills int) (*PipeConn, error) {
-	return l._acceptPipe(mills)
+	if mills <= 0 {
+		return l.AcceptContext(context.Background())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(mills)*time.Millisecond)
+	defer cancel()
+	conn, err := l.AcceptContext(ctx)
+	if err == context.DeadlineExceeded {
+		return nil, PipeError{"wait timeout", true}
+	}
+	return conn, err
 }
 
 // AcceptPipe accepts the next incoming call and returns the new connection.
 func (l *PipeListener) AcceptPipe() (*PipeConn, error) {
-	return l._acceptPipe(0)
+	return l.AcceptContext(context.Background())
 }
 
 // Close stops listening on the address.
@@ -399,6 +739,31 @@ func (l *PipeListener) Close() error {
 		return nil
 	}
 	l.closed = true
+
+	if l.poolDone != nil {
+		// poolStopped, the handle snapshot, and closing poolDone must
+		// all happen in one critical section: a worker registering a
+		// freshly created replacement handle checks poolStopped under
+		// the same lock, so whichever of the two critical sections
+		// (this one or the worker's) runs first is guaranteed to see
+		// the other's effect, and no handle can fall in a gap that
+		// neither side accounts for.
+		l.poolMu.Lock()
+		l.poolStopped = true
+		handles := append([]syscall.Handle(nil), l.poolHandles...)
+		close(l.poolDone)
+		l.poolMu.Unlock()
+		for _, h := range handles {
+			if h != 0 {
+				syscall.CancelIoEx(h, nil)
+				syscall.CloseHandle(h)
+			}
+		}
+		l.poolWG.Wait()
+		close(l.acceptCh)
+		return nil
+	}
+
 	if l.handle != 0 {
 		err := disconnectNamedPipe(l.handle)
 		l.handle = 0
@@ -415,9 +780,144 @@ type PipeConn struct {
 	handle syscall.Handle
 	addr   PipeAddr
 
-	// these aren't actually used yet
-	readDeadline  *time.Time
-	writeDeadline *time.Time
+	// messageMode is set on connections opened with ListenMessage or
+	// DialMessage; it gates ReadMessage/WriteMessage.
+	messageMode bool
+
+	readWatcher  *pipeWatcher
+	writeWatcher *pipeWatcher
+}
+
+// newPipeConn builds a PipeConn ready to use, wiring up the read/write
+// watchers that back SetReadDeadline/SetWriteDeadline and Close.
+func newPipeConn(handle syscall.Handle, addr PipeAddr, messageMode bool) *PipeConn {
+	return &PipeConn{
+		handle:       handle,
+		addr:         addr,
+		messageMode:  messageMode,
+		readWatcher:  newPipeWatcher(handle),
+		writeWatcher: newPipeWatcher(handle),
+	}
+}
+
+// pipeWatcher tracks the overlapped operation currently in flight for one
+// direction (read or write) of a PipeConn. It exists so that a deadline
+// set after the operation has already started -- or a Close from another
+// goroutine -- can still interrupt a blocked Read or Write via CancelIoEx,
+// which a bare "store the deadline and pass it to the next wait" scheme
+// cannot do.
+type pipeWatcher struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	handle     syscall.Handle
+	overlapped *syscall.Overlapped
+	deadline   time.Time // zero means no deadline
+	timer      *time.Timer
+	closed     bool
+}
+
+func newPipeWatcher(handle syscall.Handle) *pipeWatcher {
+	w := &pipeWatcher{handle: handle}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// begin registers overlapped as the operation currently in flight and arms
+// the timer for the configured deadline, if any. The caller must invoke
+// the returned function once the operation has completed, which is what
+// lets stop (and so Close) know when it is safe to close the handle.
+func (w *pipeWatcher) begin(overlapped *syscall.Overlapped) func() {
+	w.mu.Lock()
+	w.overlapped = overlapped
+	w.armTimer()
+	w.mu.Unlock()
+	return func() {
+		w.mu.Lock()
+		w.overlapped = nil
+		if w.timer != nil {
+			w.timer.Stop()
+			w.timer = nil
+		}
+		w.mu.Unlock()
+		w.cond.Broadcast()
+	}
+}
+
+// armTimer must be called with w.mu held. It (re)schedules the timer that
+// will call CancelIoEx once the deadline elapses.
+func (w *pipeWatcher) armTimer() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.deadline.IsZero() {
+		return
+	}
+	if remaining := time.Until(w.deadline); remaining > 0 {
+		w.timer = time.AfterFunc(remaining, w.cancel)
+	} else {
+		w.cancelLocked()
+	}
+}
+
+func (w *pipeWatcher) cancel() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cancelLocked()
+}
+
+// cancelLocked must be called with w.mu held.
+func (w *pipeWatcher) cancelLocked() {
+	if w.overlapped != nil {
+		syscall.CancelIoEx(w.handle, w.overlapped)
+	}
+}
+
+// expired reports whether the configured deadline has already passed, so
+// callers can fail a new Read/Write immediately instead of issuing it and
+// waiting for CancelIoEx to unwind it.
+func (w *pipeWatcher) expired() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !w.deadline.IsZero() && !time.Now().Before(w.deadline)
+}
+
+// isClosed reports whether stop has been called, so a cancelled operation
+// can be reported as a closed connection rather than a timeout.
+func (w *pipeWatcher) isClosed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closed
+}
+
+// setDeadline updates the deadline, re-arming the timer around any
+// operation that is currently in flight.
+func (w *pipeWatcher) setDeadline(t time.Time) {
+	w.mu.Lock()
+	w.deadline = t
+	w.armTimer()
+	w.mu.Unlock()
+}
+
+// stop marks the watcher closed, cancels any operation in flight, and
+// blocks until that operation's begin/done pair has completed. CancelIoEx
+// only requests cancellation; per its documentation the I/O isn't
+// guaranteed done until GetOverlappedResult returns, and closing a handle
+// out from under a still-outstanding overlapped operation is undefined
+// behavior. Waiting here, instead of only in the blocked Read/Write
+// goroutine, is what lets PipeConn.Close call CloseHandle safely.
+func (w *pipeWatcher) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.cancelLocked()
+	for w.overlapped != nil {
+		w.cond.Wait()
+	}
 }
 
 type iodata struct {
@@ -425,42 +925,46 @@ type iodata struct {
 	err error
 }
 
-// completeRequest looks at iodata to see if a request is pending. If so, it waits for it to either complete or to
-// abort due to hitting the specified deadline. Deadline may be set to nil to wait forever. If no request is pending,
-// the content of iodata is returned.
-func (c *PipeConn) completeRequest(data iodata, deadline *time.Time, overlapped *syscall.Overlapped) (int, error) {
+// completeRequest looks at iodata to see if a request is pending. If so, it
+// waits for it to complete, however long that takes; a deadline set on
+// watcher is what makes that wait finite, by calling CancelIoEx once it
+// elapses. If no request is pending, the content of iodata is returned
+// as-is. The returned bool reports whether the operation stopped early
+// because the message-mode pipe had more data for the current message than
+// fit in the caller's buffer (ERROR_MORE_DATA).
+func (c *PipeConn) completeRequest(data iodata, watcher *pipeWatcher, overlapped *syscall.Overlapped) (int, bool, error) {
 	if data.err == error_io_incomplete || data.err == syscall.ERROR_IO_PENDING {
-		//var timer <-chan time.Time
-		var mills int = 0
-		var nowt time.Time
-		if deadline != nil {
-			nowt = time.Now()
-			if timeDiff := deadline.Sub(nowt); timeDiff > 0 {
-				//timer = time.After(timeDiff)
-				mills, _ = strconv.Atoi(fmt.Sprintf("%d", deadline.Sub(nowt)/time.Millisecond))
-			}
-		}
-		n, err := waitForCompletion(c.handle, mills, overlapped)
-		if err != nil {
-			neterr, ok := err.(net.Error)
-			if ok && neterr.Timeout() {
-				/*we cancel handle*/
-				syscall.CancelIoEx(c.handle, overlapped)
-			}
-		}
+		n, err := waitForCompletion(c.handle, 0, overlapped)
 		data = iodata{n, err}
 	}
+	if data.err == syscall.ERROR_OPERATION_ABORTED {
+		// Either the deadline elapsed or Close ran concurrently;
+		// watcher tells us which one CancelIoEx was reacting to.
+		if watcher.isClosed() {
+			data.err = PipeError{"use of closed network connection", false}
+		} else {
+			data.err = PipeError{"i/o timeout", true}
+		}
+	}
 	// Windows will produce ERROR_BROKEN_PIPE upon closing
 	// a handle on the other end of a connection. Go RPC
 	// expects an io.EOF error in this case.
 	if data.err == syscall.ERROR_BROKEN_PIPE {
 		data.err = io.EOF
 	}
-	return int(data.n), data.err
+	more := false
+	if data.err == syscall.ERROR_MORE_DATA {
+		more = true
+		data.err = nil
+	}
+	return int(data.n), more, data.err
 }
 
 // Read implements the net.Conn Read method.
 func (c *PipeConn) Read(b []byte) (int, error) {
+	if c.readWatcher.expired() {
+		return 0, PipeError{"i/o timeout", true}
+	}
 	// Use ReadFile() rather than Read() because the latter
 	// contains a workaround that eats ERROR_BROKEN_PIPE.
 	overlapped, err := newOverlapped()
@@ -468,28 +972,174 @@ func (c *PipeConn) Read(b []byte) (int, error) {
 		return 0, err
 	}
 	defer syscall.CloseHandle(overlapped.HEvent)
+	done := c.readWatcher.begin(overlapped)
+	defer done()
 	var n uint32
 	err = syscall.ReadFile(c.handle, b, &n, overlapped)
-	return c.completeRequest(iodata{n, err}, c.readDeadline, overlapped)
+	nr, _, err := c.completeRequest(iodata{n, err}, c.readWatcher, overlapped)
+	return nr, err
 }
 
 // Write implements the net.Conn Write method.
 func (c *PipeConn) Write(b []byte) (int, error) {
+	if c.writeWatcher.expired() {
+		return 0, PipeError{"i/o timeout", true}
+	}
 	overlapped, err := newOverlapped()
 	if err != nil {
 		return 0, err
 	}
 	defer syscall.CloseHandle(overlapped.HEvent)
+	done := c.writeWatcher.begin(overlapped)
+	defer done()
 	var n uint32
 	err = syscall.WriteFile(c.handle, b, &n, overlapped)
-	return c.completeRequest(iodata{n, err}, c.writeDeadline, overlapped)
+	nw, _, err := c.completeRequest(iodata{n, err}, c.writeWatcher, overlapped)
+	return nw, err
+}
+
+// ReadMessage reads a single message from a message-mode pipe opened with
+// ListenMessage or DialMessage into b. If the message is larger than b,
+// ReadMessage returns the bytes that fit with more set to true; the
+// remainder of the message can be read with a subsequent ReadMessage call.
+// ReadMessage returns an error if the connection is not in message mode.
+func (c *PipeConn) ReadMessage(b []byte) (n int, more bool, err error) {
+	if !c.messageMode {
+		return 0, false, PipeError{"ReadMessage called on a byte-mode pipe", false}
+	}
+	if c.readWatcher.expired() {
+		return 0, false, PipeError{"i/o timeout", true}
+	}
+	overlapped, err := newOverlapped()
+	if err != nil {
+		return 0, false, err
+	}
+	defer syscall.CloseHandle(overlapped.HEvent)
+	done := c.readWatcher.begin(overlapped)
+	defer done()
+	var nn uint32
+	err = syscall.ReadFile(c.handle, b, &nn, overlapped)
+	return c.completeRequest(iodata{nn, err}, c.readWatcher, overlapped)
+}
+
+// WriteMessage writes b as a single message on a message-mode pipe opened
+// with ListenMessage or DialMessage; the reader's ReadMessage calls will
+// see the same boundaries the writer used. WriteMessage returns an error
+// if the connection is not in message mode.
+func (c *PipeConn) WriteMessage(b []byte) error {
+	if !c.messageMode {
+		return PipeError{"WriteMessage called on a byte-mode pipe", false}
+	}
+	_, err := c.Write(b)
+	return err
 }
 
 // Close closes the connection.
 func (c *PipeConn) Close() error {
+	// stop cancels any in-flight Read/Write and blocks until it has
+	// actually finished, so CloseHandle below never races a still-
+	// outstanding overlapped operation.
+	c.readWatcher.stop()
+	c.writeWatcher.stop()
 	return syscall.CloseHandle(c.handle)
 }
 
+// ClientPid returns the process ID of the client at the other end of a
+// server-side connection returned by PipeListener.Accept. It is only
+// meaningful on the server end of a pipe.
+func (c *PipeConn) ClientPid() (uint32, error) {
+	var pid uint32
+	if err := getNamedPipeClientProcessId(c.handle, &pid); err != nil {
+		return 0, os.NewSyscallError("GetNamedPipeClientProcessId", err)
+	}
+	return pid, nil
+}
+
+// ClientSid returns the string SID (e.g. "S-1-5-21-...") of the client at
+// the other end of a server-side connection returned by
+// PipeListener.Accept, so servers can authenticate callers without a full
+// impersonation. It is only meaningful on the server end of a pipe.
+func (c *PipeConn) ClientSid() (string, error) {
+	pid, err := c.ClientPid()
+	if err != nil {
+		return "", err
+	}
+
+	process, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, pid)
+	if err != nil {
+		return "", os.NewSyscallError("OpenProcess", err)
+	}
+	defer syscall.CloseHandle(process)
+
+	var token syscall.Token
+	if err := syscall.OpenProcessToken(process, syscall.TOKEN_QUERY, &token); err != nil {
+		return "", os.NewSyscallError("OpenProcessToken", err)
+	}
+	defer token.Close()
+
+	user, err := token.GetTokenUser()
+	if err != nil {
+		return "", os.NewSyscallError("GetTokenInformation", err)
+	}
+
+	return user.User.Sid.String()
+}
+
+// Impersonate runs fn with this goroutine's OS thread impersonating the
+// client at the other end of a server-side connection returned by
+// PipeListener.Accept, reverting to the server's own security context
+// before Impersonate returns, even if fn returns an error. Impersonation
+// is a per-thread property on Windows, so the goroutine is locked to its
+// OS thread for the duration.
+//
+// If RevertToSelf fails, Impersonate panics rather than unlocking the
+// thread: an OS thread stuck impersonating the client must never be
+// returned to the scheduler's pool, where an unrelated goroutine could be
+// scheduled onto it and unknowingly run with the client's security
+// context.
+func (c *PipeConn) Impersonate(fn func() error) error {
+	runtime.LockOSThread()
+
+	if err := impersonateNamedPipeClient(c.handle); err != nil {
+		runtime.UnlockOSThread()
+		return os.NewSyscallError("ImpersonateNamedPipeClient", err)
+	}
+
+	defer func() {
+		if err := revertToSelf(); err != nil {
+			// The thread is still impersonating the client; it must
+			// not go back into the scheduler's pool, where an
+			// unrelated goroutine could be scheduled onto it and
+			// unknowingly run with the client's security context.
+			panic(os.NewSyscallError("RevertToSelf", err))
+		}
+		runtime.UnlockOSThread()
+	}()
+
+	return fn()
+}
+
+// RunAsClient is a package-level spelling of c.Impersonate, for callers
+// who find "run this as the client" more readable at the call site. See
+// Impersonate for the panic behavior if reverting impersonation fails.
+func RunAsClient(c *PipeConn, fn func() error) error {
+	return c.Impersonate(fn)
+}
+
+// ClientToken returns the calling thread's impersonation token. It is
+// only meaningful from within the fn passed to Impersonate/RunAsClient,
+// where the token identifies the connected client rather than the server
+// process, so callers can inspect the client's SID, groups, and
+// privileges before deciding whether to service the request.
+func (c *PipeConn) ClientToken() (syscall.Token, error) {
+	thread := getCurrentThread()
+	var token syscall.Token
+	if err := openThreadToken(thread, syscall.TOKEN_QUERY, false, &token); err != nil {
+		return 0, os.NewSyscallError("OpenThreadToken", err)
+	}
+	return token, nil
+}
+
 // LocalAddr returns the local network address.
 func (c *PipeConn) LocalAddr() net.Addr {
 	return c.addr
@@ -512,14 +1162,14 @@ func (c *PipeConn) SetDeadline(t time.Time) error {
 // SetReadDeadline implements the net.Conn SetReadDeadline method.
 // Note that timeouts are only supported on Windows Vista/Server 2008 and above
 func (c *PipeConn) SetReadDeadline(t time.Time) error {
-	c.readDeadline = &t
+	c.readWatcher.setDeadline(t)
 	return nil
 }
 
 // SetWriteDeadline implements the net.Conn SetWriteDeadline method.
 // Note that timeouts are only supported on Windows Vista/Server 2008 and above
 func (c *PipeConn) SetWriteDeadline(t time.Time) error {
-	c.writeDeadline = &t
+	c.writeWatcher.setDeadline(t)
 	return nil
 }
 
@@ -534,11 +1184,58 @@ func (a PipeAddr) String() string {
 	return string(a)
 }
 
-// createPipe is a helper function to make sure we always create pipes
-// with the same arguments, since subsequent calls to create pipe need
-// to use the same arguments as the first one. If first is set, fail
-// if the pipe already exists.
-func createPipe(address string, first bool) (syscall.Handle, error) {
+// PipePacketConn adapts a message-mode PipeConn (opened via ListenMessage
+// or DialMessage) to the net.PacketConn interface, so message boundaries
+// are preserved end-to-end through code written against that interface.
+type PipePacketConn struct {
+	conn *PipeConn
+}
+
+// NewPipePacketConn wraps conn, which must be in message mode, as a
+// net.PacketConn.
+func NewPipePacketConn(conn *PipeConn) *PipePacketConn {
+	return &PipePacketConn{conn: conn}
+}
+
+// ReadFrom implements the net.PacketConn ReadFrom method. It reads a
+// single message and returns the connection's RemoteAddr as the sender,
+// since named pipes are point-to-point.
+func (p *PipePacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, _, err = p.conn.ReadMessage(b)
+	return n, p.conn.RemoteAddr(), err
+}
+
+// WriteTo implements the net.PacketConn WriteTo method. addr is ignored,
+// since named pipes are point-to-point.
+func (p *PipePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if err := p.conn.WriteMessage(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close implements the net.PacketConn Close method.
+func (p *PipePacketConn) Close() error { return p.conn.Close() }
+
+// LocalAddr implements the net.PacketConn LocalAddr method.
+func (p *PipePacketConn) LocalAddr() net.Addr { return p.conn.LocalAddr() }
+
+// SetDeadline implements the net.PacketConn SetDeadline method.
+func (p *PipePacketConn) SetDeadline(t time.Time) error { return p.conn.SetDeadline(t) }
+
+// SetReadDeadline implements the net.PacketConn SetReadDeadline method.
+func (p *PipePacketConn) SetReadDeadline(t time.Time) error { return p.conn.SetReadDeadline(t) }
+
+// SetWriteDeadline implements the net.PacketConn SetWriteDeadline method.
+func (p *PipePacketConn) SetWriteDeadline(t time.Time) error { return p.conn.SetWriteDeadline(t) }
+
+// createPipeConfigured is a helper function to make sure we always create
+// pipes with the same arguments, since subsequent calls to create pipe need
+// to use the same arguments as the first one. If first is set, fail if the
+// pipe already exists. A nil cfg is equivalent to resolveListenConfig(nil).
+func createPipeConfigured(address string, first bool, cfg *ListenConfig) (syscall.Handle, error) {
+	resolved := resolveListenConfig(cfg)
+
 	n, err := syscall.UTF16PtrFromString(address)
 	if err != nil {
 		return 0, err
@@ -547,12 +1244,35 @@ func createPipe(address string, first bool) (syscall.Handle, error) {
 	if first {
 		mode |= file_flag_first_pipe_instance
 	}
-	sa, err := initSecurityAttributes()
+
+	var sa *syscall.SecurityAttributes
+	if resolved.SecurityDescriptor != "" {
+		sa, err = securityAttributesFromSDDL(resolved.SecurityDescriptor)
+		if err != nil {
+			return 0, err
+		}
+		// CreateNamedPipe copies the security descriptor it's given; the
+		// buffer ConvertStringSecurityDescriptorToSecurityDescriptorW
+		// allocated for it via LocalAlloc is ours to free once the call
+		// below returns, whether it succeeds or not.
+		defer syscall.LocalFree(syscall.Handle(sa.SecurityDescriptor))
+	} else {
+		sa, err = initSecurityAttributes()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	pipeMode := uint32(pipe_type_byte | pipe_readmode_byte)
+	if resolved.MessageMode {
+		pipeMode = pipe_type_message | pipe_readmode_message
+	}
+
 	return createNamedPipe(n,
 		mode,
-		pipe_type_byte,
-		pipe_unlimited_instances,
-		512, 512, 0, sa)
+		pipeMode,
+		resolved.MaxInstances,
+		resolved.OutBufferSize, resolved.InBufferSize, 0, sa)
 }
 
 func badAddr(addr string) PipeError {
@@ -0,0 +1,173 @@
+// Copyright 2013 Nate Finch. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package npipe
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestResolveListenConfigDefaults(t *testing.T) {
+	resolved := resolveListenConfig(nil)
+	if resolved.OutBufferSize != 512 || resolved.InBufferSize != 512 {
+		t.Fatalf("resolveListenConfig(nil) buffer sizes = %d/%d, want 512/512",
+			resolved.OutBufferSize, resolved.InBufferSize)
+	}
+	if resolved.MaxInstances != pipe_unlimited_instances {
+		t.Fatalf("resolveListenConfig(nil).MaxInstances = %d, want %d",
+			resolved.MaxInstances, pipe_unlimited_instances)
+	}
+
+	cfg := &ListenConfig{
+		OutBufferSize: 4096,
+		InBufferSize:  8192,
+		MaxInstances:  4,
+		MessageMode:   true,
+	}
+	resolved = resolveListenConfig(cfg)
+	if resolved.OutBufferSize != 4096 || resolved.InBufferSize != 8192 ||
+		resolved.MaxInstances != 4 || !resolved.MessageMode {
+		t.Fatalf("resolveListenConfig(cfg) = %+v, want explicit fields preserved", resolved)
+	}
+}
+
+func TestReadMessageWriteMessageRequireMessageMode(t *testing.T) {
+	c := &PipeConn{}
+	if _, _, err := c.ReadMessage(make([]byte, 16)); err == nil {
+		t.Fatal("ReadMessage on a byte-mode PipeConn should fail")
+	}
+	if err := c.WriteMessage([]byte("hi")); err == nil {
+		t.Fatal("WriteMessage on a byte-mode PipeConn should fail")
+	}
+}
+
+func TestCompleteRequestMoreData(t *testing.T) {
+	c := &PipeConn{}
+	watcher := newPipeWatcher(0)
+	n, more, err := c.completeRequest(iodata{5, syscall.ERROR_MORE_DATA}, watcher, nil)
+	if err != nil || !more || n != 5 {
+		t.Fatalf("completeRequest(ERROR_MORE_DATA) = (%d, %v, %v), want (5, true, nil)", n, more, err)
+	}
+}
+
+func TestDialContextCanceledBeforeStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DialContext(ctx, `\\.\pipe\npipe-test-canceled`); !errors.Is(err, context.Canceled) {
+		t.Fatalf("DialContext with an already-canceled ctx returned err = %v, want context.Canceled", err)
+	}
+}
+
+// TestPipeWatcherStopWaitsForInFlightOp pins the fix that made Close
+// synchronous with a canceled Read/Write: stop must not return while an
+// operation begin() registered is still in flight, since the caller closes
+// the handle right after stop returns.
+func TestPipeWatcherStopWaitsForInFlightOp(t *testing.T) {
+	w := newPipeWatcher(0)
+	done := w.begin(&syscall.Overlapped{})
+
+	var doneRan int32
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&doneRan, 1)
+		done()
+	}()
+
+	w.stop()
+	if atomic.LoadInt32(&doneRan) == 0 {
+		t.Fatal("stop returned before the in-flight operation's done() ran")
+	}
+}
+
+// TestPipeListenerPoolCloseIdempotent exercises the pool teardown path of
+// Close (poolStopped snapshot, draining poolHandles, closing acceptCh) with
+// no workers registered, and confirms a second Close is a safe no-op.
+func TestPipeListenerPoolCloseIdempotent(t *testing.T) {
+	l := &PipeListener{
+		addr:        PipeAddr(`\\.\pipe\npipe-test-pool`),
+		acceptCh:    make(chan *PipeConn, 1),
+		poolDone:    make(chan struct{}),
+		poolHandles: make([]syscall.Handle, 0),
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("first Close() = %v, want nil", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("second Close() = %v, want nil (idempotent)", err)
+	}
+
+	select {
+	case _, ok := <-l.acceptCh:
+		if ok {
+			t.Fatal("acceptCh should be closed after Close")
+		}
+	default:
+		t.Fatal("acceptCh should be closed, so a read should not block")
+	}
+}
+
+// TestCommitPoolHandleRacesClose drives the exact race runPoolWorker and
+// Close run over: a worker that just connected a handle trying to commit
+// it for handoff, concurrently with Close taking its snapshot. Whichever
+// side observes poolStopped first must end up owning the handle alone,
+// with no gap where both (or neither) would act on it.
+func TestCommitPoolHandleRacesClose(t *testing.T) {
+	const trials = 200
+	for trial := 0; trial < trials; trial++ {
+		l := &PipeListener{
+			addr:        PipeAddr(`\\.\pipe\npipe-test-pool-race`),
+			acceptCh:    make(chan *PipeConn, 1),
+			poolDone:    make(chan struct{}),
+			poolHandles: []syscall.Handle{syscall.Handle(0x1000 + trial)},
+		}
+
+		var committed int32
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if l.commitPoolHandle(0) {
+				atomic.StoreInt32(&committed, 1)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			l.Close()
+		}()
+		wg.Wait()
+
+		if atomic.LoadInt32(&committed) == 1 {
+			// The worker won: it now owns handle 0, so Close's
+			// snapshot must not have captured it anymore.
+			if l.poolHandles[0] != 0 {
+				t.Fatalf("trial %d: worker committed the handle but poolHandles[0] was not cleared", trial)
+			}
+		} else {
+			// Close won: it already owns closing the handle, and the
+			// worker must have backed off without clearing the slot
+			// out from under Close's snapshot.
+			if l.poolHandles[0] == 0 {
+				t.Fatalf("trial %d: Close won the race but poolHandles[0] was cleared anyway", trial)
+			}
+		}
+	}
+}
+
+// TestClientTokenOutsideImpersonateFails documents that ClientToken is only
+// meaningful inside the fn passed to Impersonate/RunAsClient: on Windows,
+// OpenThreadToken on a thread that isn't impersonating anyone fails with
+// ERROR_NO_TOKEN, so calling it outside of Impersonate must return an error
+// rather than a token for the server process itself.
+func TestClientTokenOutsideImpersonateFails(t *testing.T) {
+	c := &PipeConn{}
+	if _, err := c.ClientToken(); err == nil {
+		t.Fatal("ClientToken called outside Impersonate should fail")
+	}
+}